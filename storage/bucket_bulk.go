@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/influxdata/influxdb/v2"
+	"github.com/influxdata/influxdb/v2/kit/tracing"
+	"go.uber.org/zap"
+)
+
+// bulkDeleteWorkerCount bounds how many buckets DeleteBucketsByPrefix and
+// DeleteBucketsByOrg delete concurrently by default.
+const bulkDeleteWorkerCount = 8
+
+// bucketListPageSize is the page size used to list every bucket matching a
+// filter. FindBuckets applies a much smaller default page size when called
+// without FindOptions, which would otherwise silently cap a bulk delete to
+// its first page.
+const bucketListPageSize = 100
+
+// BulkDeleteOptions controls DeleteBucketsByPrefix and DeleteBucketsByOrg.
+type BulkDeleteOptions struct {
+	// DryRun, when true, skips deletion entirely; the matching bucket IDs
+	// are still returned.
+	DryRun bool
+
+	// Concurrency bounds how many buckets are deleted in parallel. Zero
+	// defaults to bulkDeleteWorkerCount.
+	Concurrency int
+
+	// Force deletes each matched bucket even if it still contains data,
+	// same as DeleteBucketOptions.Force. This is the common case for the
+	// test-harness / CI teardown use case bulk delete targets, where
+	// buckets are expected to hold data right up until teardown.
+	Force bool
+}
+
+// DeleteBucketsByPrefix deletes every bucket in orgID whose name starts with
+// prefix, in parallel on a bounded worker pool, and returns the IDs it
+// matched. It is meant for the common test-harness / CI pattern of
+// provisioning many ephemeral buckets under a shared prefix and needing to
+// reliably tear them all down without a serial List-then-Delete loop; pass
+// BulkDeleteOptions{Force: true} since those buckets typically still hold
+// data. A canceled ctx stops new deletes from starting but does not roll
+// back deletes already in flight; any bucket left in a half-deleted state is
+// recovered from the journal on the next BucketService startup.
+func (s *BucketService) DeleteBucketsByPrefix(ctx context.Context, orgID influxdb.ID, prefix string, opts ...BulkDeleteOptions) ([]influxdb.ID, error) {
+	span, ctx := tracing.StartSpanFromContext(ctx)
+	defer span.Finish()
+
+	opt := bulkDeleteOptions(opts)
+
+	buckets, err := s.findAllBuckets(ctx, influxdb.BucketFilter{OrgID: &orgID})
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []influxdb.ID
+	for _, b := range buckets {
+		if strings.HasPrefix(b.Name, prefix) {
+			matched = append(matched, b.ID)
+		}
+	}
+
+	if opt.DryRun {
+		return matched, nil
+	}
+
+	return matched, s.deleteBucketsConcurrently(ctx, matched, opt.Concurrency, opt.Force)
+}
+
+// DeleteBucketsByOrg deletes every bucket belonging to orgID, in parallel on
+// a bounded worker pool. See DeleteBucketsByPrefix for cancellation behavior.
+// Unlike DeleteBucketsByPrefix, DeleteBucketsByOrg returns no bucket IDs, so
+// a dry run logs the matched count and IDs instead of just discarding them.
+func (s *BucketService) DeleteBucketsByOrg(ctx context.Context, orgID influxdb.ID, opts ...BulkDeleteOptions) error {
+	span, ctx := tracing.StartSpanFromContext(ctx)
+	defer span.Finish()
+
+	opt := bulkDeleteOptions(opts)
+
+	buckets, err := s.findAllBuckets(ctx, influxdb.BucketFilter{OrgID: &orgID})
+	if err != nil {
+		return err
+	}
+
+	ids := make([]influxdb.ID, len(buckets))
+	for i, b := range buckets {
+		ids[i] = b.ID
+	}
+
+	if opt.DryRun {
+		s.log.Info("Dry run: buckets that would be deleted",
+			zap.Stringer("org_id", orgID), zap.Int("count", len(ids)), zap.Any("bucket_ids", ids))
+		return nil
+	}
+
+	return s.deleteBucketsConcurrently(ctx, ids, opt.Concurrency, opt.Force)
+}
+
+// findAllBuckets pages through every bucket matching filter, since
+// FindBuckets applies its own default page size when called without
+// FindOptions and would otherwise silently cap a bulk delete to its first
+// page.
+func (s *BucketService) findAllBuckets(ctx context.Context, filter influxdb.BucketFilter) ([]*influxdb.Bucket, error) {
+	var all []*influxdb.Bucket
+	for offset := 0; ; offset += bucketListPageSize {
+		page, _, err := s.FindBuckets(ctx, filter, influxdb.FindOptions{
+			Limit:  bucketListPageSize,
+			Offset: offset,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, page...)
+		if len(page) < bucketListPageSize {
+			return all, nil
+		}
+	}
+}
+
+func bulkDeleteOptions(opts []BulkDeleteOptions) BulkDeleteOptions {
+	var opt BulkDeleteOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.Concurrency <= 0 {
+		opt.Concurrency = bulkDeleteWorkerCount
+	}
+	return opt
+}
+
+// deleteBucketsConcurrently deletes ids on a pool of concurrency workers,
+// stopping early if ctx is canceled, and returns every per-bucket failure
+// rather than just the first.
+func (s *BucketService) deleteBucketsConcurrently(ctx context.Context, ids []influxdb.ID, concurrency int, force bool) error {
+	sem := make(chan struct{}, concurrency)
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs bulkDeleteError
+	)
+
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			// Checked explicitly rather than folded into the select below:
+			// select picks pseudo-randomly among ready cases, so with both
+			// ctx.Done() and a free sem slot ready at once, it could still
+			// launch a new delete after cancellation.
+			mu.Lock()
+			errs = append(errs, fmt.Errorf("bucket %s: %w", id, ctx.Err()))
+			mu.Unlock()
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			errs = append(errs, fmt.Errorf("bucket %s: %w", id, ctx.Err()))
+			mu.Unlock()
+			continue
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(id influxdb.ID) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := s.DeleteBucket(ctx, id, DeleteBucketOptions{Force: force}); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("bucket %s: %w", id, err))
+				mu.Unlock()
+			}
+		}(id)
+	}
+
+	wg.Wait()
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// bulkDeleteError collects one error per bucket that failed to delete, so a
+// caller can see every failure from a bulk delete rather than just the
+// first.
+type bulkDeleteError []error
+
+func (e bulkDeleteError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d bucket(s) failed to delete: %s", len(e), strings.Join(msgs, "; "))
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/influxdata/influxdb/v2"
+	"github.com/influxdata/influxdb/v2/kit/tracing"
+	"go.uber.org/zap"
+)
+
+// BucketLifecyclePhase identifies which half of a hook's two-phase
+// invocation is running.
+type BucketLifecyclePhase int
+
+const (
+	// PreCommit runs before the mutation has been written to the metadata
+	// store, while it can still be abandoned cheaply.
+	PreCommit BucketLifecyclePhase = iota
+	// PostCommit runs after the metadata store has accepted the mutation,
+	// when the hook must either succeed or be compensated.
+	PostCommit
+)
+
+func (p BucketLifecyclePhase) String() string {
+	if p == PreCommit {
+		return "pre-commit"
+	}
+	return "post-commit"
+}
+
+// bucketLifecycleOp identifies which BucketService method triggered a hook
+// invocation, for use in HookError.
+type bucketLifecycleOp string
+
+const (
+	bucketLifecycleCreate bucketLifecycleOp = "create"
+	bucketLifecycleUpdate bucketLifecycleOp = "update"
+	bucketLifecycleDelete bucketLifecycleOp = "delete"
+)
+
+// BucketLifecycleHook lets a subsystem observe bucket mutations without
+// BucketService growing a dedicated interface for every consumer. Hooks are
+// invoked in registration order for both phases of a mutation; if a hook
+// fails, the hooks that already ran for that phase are compensated in
+// reverse registration order.
+type BucketLifecycleHook interface {
+	OnCreate(ctx context.Context, phase BucketLifecyclePhase, b *influxdb.Bucket) error
+	OnUpdate(ctx context.Context, phase BucketLifecyclePhase, b *influxdb.Bucket, upd influxdb.BucketUpdate) error
+	OnDelete(ctx context.Context, phase BucketLifecyclePhase, b *influxdb.Bucket, opts DeleteBucketOptions) error
+}
+
+// HookError reports which registered hook failed during a bucket lifecycle
+// operation, and whether the hooks that had already run for that phase were
+// successfully compensated.
+type HookError struct {
+	Op          bucketLifecycleOp
+	Phase       BucketLifecyclePhase
+	Hook        string
+	Err         error
+	Compensated bool
+}
+
+func (e *HookError) Error() string {
+	status := "compensated"
+	if !e.Compensated {
+		status = "compensation incomplete"
+	}
+	return fmt.Sprintf("bucket lifecycle hook %q failed during %s %s (%s): %s", e.Hook, e.Op, e.Phase, status, e.Err)
+}
+
+func (e *HookError) Unwrap() error { return e.Err }
+
+type registeredHook struct {
+	name string
+	hook BucketLifecycleHook
+}
+
+// RegisterHook adds h, identified by name, to the end of the ordered chain
+// of hooks invoked around every bucket create, update and delete. name is
+// used in logs, traces and HookError to identify which hook is responsible
+// for a failure. RegisterHook is not safe to call concurrently with bucket
+// mutations; register all hooks before serving traffic.
+func (s *BucketService) RegisterHook(name string, h BucketLifecycleHook) {
+	s.hooks = append(s.hooks, registeredHook{name: name, hook: h})
+}
+
+// runHooks invokes fn for every registered hook, in order, under its own
+// tracing span. If fn returns an error for hook i, the hooks [0, i) are
+// compensated via compensate, in reverse order, and a *HookError is
+// returned describing the failure.
+func (s *BucketService) runHooks(
+	ctx context.Context,
+	op bucketLifecycleOp,
+	phase BucketLifecyclePhase,
+	fn func(context.Context, BucketLifecycleHook) error,
+	compensate func(context.Context, BucketLifecycleHook) error,
+) error {
+	for i, rh := range s.hooks {
+		span, hctx := tracing.StartSpanFromContext(ctx)
+		span.SetTag("hook", rh.name)
+		span.SetTag("op", string(op))
+		span.SetTag("phase", phase.String())
+
+		err := fn(hctx, rh.hook)
+		span.Finish()
+		if err == nil {
+			continue
+		}
+
+		s.log.Error("Bucket lifecycle hook failed",
+			zap.String("hook", rh.name),
+			zap.String("op", string(op)),
+			zap.String("phase", phase.String()),
+			zap.Error(err))
+
+		compensated := true
+		for j := i - 1; j >= 0; j-- {
+			prior := s.hooks[j]
+			cspan, cctx := tracing.StartSpanFromContext(ctx)
+			cspan.SetTag("hook", prior.name)
+			cspan.SetTag("compensating_for", rh.name)
+			cerr := compensate(cctx, prior.hook)
+			cspan.Finish()
+			if cerr != nil {
+				s.log.Error("Unable to compensate bucket lifecycle hook",
+					zap.String("hook", prior.name),
+					zap.String("op", string(op)),
+					zap.Error(cerr))
+				compensated = false
+			}
+		}
+
+		return &HookError{Op: op, Phase: phase, Hook: rh.name, Err: err, Compensated: compensated}
+	}
+
+	return nil
+}
+
+// engineHook adapts the original EngineSchema interface into a
+// BucketLifecycleHook so the storage engine is just the first of
+// potentially many registered hooks.
+type engineHook struct {
+	engine EngineSchema
+}
+
+func (h *engineHook) OnCreate(ctx context.Context, phase BucketLifecyclePhase, b *influxdb.Bucket) error {
+	if phase != PostCommit {
+		return nil
+	}
+	return h.engine.CreateBucket(ctx, b)
+}
+
+// OnUpdate is a no-op: retention period changes are applied to the engine
+// asynchronously by BucketService's retentionQueue rather than inline as
+// part of the hook chain. See BucketService.UpdateBucket.
+func (h *engineHook) OnUpdate(ctx context.Context, phase BucketLifecyclePhase, b *influxdb.Bucket, upd influxdb.BucketUpdate) error {
+	return nil
+}
+
+// OnDelete runs on PreCommit, before the metadata entry is deleted: the
+// engine both enforces the non-empty guard (DeleteBucketOptions{Force:
+// false}) and drops the data here, so a refusal leaves the metadata entry in
+// place for the data the engine kept, rather than deleting the metadata of a
+// bucket whose data still exists.
+func (h *engineHook) OnDelete(ctx context.Context, phase BucketLifecyclePhase, b *influxdb.Bucket, opts DeleteBucketOptions) error {
+	if phase != PreCommit {
+		return nil
+	}
+	return h.engine.DeleteBucket(ctx, b.OrgID, b.ID, opts)
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/influxdata/influxdb/v2"
+	"github.com/influxdata/influxdb/v2/kv"
+	"go.uber.org/zap"
+)
+
+// bucketJournalBucket is the bolt bucket that backs the bucket lifecycle
+// journal. It is kept separate from the bucket metadata bucket so a crash
+// mid-mutation never corrupts the metadata that replay needs to read.
+var bucketJournalBucket = []byte("bucketlifecyclejournal")
+
+// journalOp identifies which BucketService operation a journal entry belongs
+// to.
+type journalOp string
+
+const (
+	journalOpCreate    journalOp = "create"
+	journalOpDelete    journalOp = "delete"
+	journalOpRetention journalOp = "retention"
+)
+
+// journalEntry records enough state about an in-flight bucket mutation to
+// roll it forward or back if the process dies between the metadata store
+// write and the storage engine write.
+type journalEntry struct {
+	Op       journalOp   `json:"op"`
+	BucketID influxdb.ID `json:"bucketID"`
+	OrgID    influxdb.ID `json:"orgID"`
+
+	// Bucket is the full bucket record being created or deleted. Replay
+	// needs it to roll a create forward (recreating the engine bucket
+	// rather than deleting metadata that's already live) and to finish a
+	// delete's PostCommit hook chain once both stores agree the bucket is
+	// gone.
+	Bucket *influxdb.Bucket `json:"bucket,omitempty"`
+
+	// PrevRetention and TargetRetention are only populated for
+	// journalOpRetention entries. They let replay tell whether the
+	// metadata commit in UpdateBucket landed before the crash: if the
+	// bucket's current retention period is still PrevRetention, it didn't,
+	// and there is nothing to resume; if it's TargetRetention, the
+	// retentionQueue record for it may not have made it to disk, so replay
+	// writes one.
+	PrevRetention   time.Duration `json:"prevRetention,omitempty"`
+	TargetRetention time.Duration `json:"targetRetention,omitempty"`
+}
+
+// bucketJournal is a write-ahead log of in-flight bucket lifecycle
+// operations, persisted so BucketService.CreateBucket, UpdateBucket and
+// DeleteBucket form a crash-safe two-phase commit across the metadata store
+// and the storage engine (and, for a retention period change, the
+// retentionQueue's own durable record of the pending engine-side apply).
+type bucketJournal struct {
+	store kv.Store
+}
+
+func newBucketJournal(store kv.Store) *bucketJournal {
+	return &bucketJournal{store: store}
+}
+
+// write persists entry under opID before the corresponding engine mutation
+// is attempted.
+func (j *bucketJournal) write(ctx context.Context, opID influxdb.ID, entry journalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return j.store.Update(ctx, func(tx kv.Tx) error {
+		bkt, err := tx.Bucket(bucketJournalBucket)
+		if err != nil {
+			return err
+		}
+		key, err := opID.Encode()
+		if err != nil {
+			return err
+		}
+		return bkt.Put(key, data)
+	})
+}
+
+// clear removes the entry for opID once its engine mutation has committed.
+func (j *bucketJournal) clear(ctx context.Context, opID influxdb.ID) error {
+	return j.store.Update(ctx, func(tx kv.Tx) error {
+		bkt, err := tx.Bucket(bucketJournalBucket)
+		if err != nil {
+			return err
+		}
+		key, err := opID.Encode()
+		if err != nil {
+			return err
+		}
+		return bkt.Delete(key)
+	})
+}
+
+// forEach visits every entry left behind by an incomplete operation, in key
+// order. It is only ever called once, during BucketService startup replay.
+func (j *bucketJournal) forEach(ctx context.Context, fn func(opID influxdb.ID, entry journalEntry) error) error {
+	return j.store.View(ctx, func(tx kv.Tx) error {
+		bkt, err := tx.Bucket(bucketJournalBucket)
+		if err != nil {
+			return err
+		}
+
+		cur, err := bkt.ForwardCursor(nil)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+
+		for k, v := cur.Next(); k != nil; k, v = cur.Next() {
+			var opID influxdb.ID
+			if err := opID.Decode(k); err != nil {
+				return err
+			}
+			var entry journalEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if err := fn(opID, entry); err != nil {
+				return err
+			}
+		}
+		return cur.Err()
+	})
+}
+
+// replay rolls forward or back every entry left in the journal by a process
+// that crashed between a metadata store write and a storage engine write. It
+// is run once, synchronously, from NewBucketService before the service is
+// handed to callers.
+func (s *BucketService) replay(ctx context.Context) error {
+	return s.journal.forEach(ctx, func(opID influxdb.ID, entry journalEntry) error {
+		var err error
+		switch entry.Op {
+		case journalOpDelete:
+			// The engine wipe may not have completed; retry it. This is
+			// idempotent via Force, whether or not the first attempt
+			// actually succeeded before the crash.
+			if err = s.engine.DeleteBucket(ctx, entry.OrgID, entry.BucketID, DeleteBucketOptions{Force: true}); err != nil {
+				break
+			}
+
+			// The engine side is done. If the metadata delete never
+			// committed, finish it now rather than leave an orphaned
+			// metadata record with no backing engine data and no journal
+			// entry left to retry it.
+			if _, ferr := s.FindBucketByID(ctx, entry.BucketID); ferr == nil {
+				if err = s.BucketService.DeleteBucket(ctx, entry.BucketID); err != nil {
+					break
+				}
+			} else if influxdb.ErrorCode(ferr) != influxdb.ENotFound {
+				err = ferr
+				break
+			}
+
+			// Both stores now agree the bucket is gone; finish notifying
+			// the rest of the hook chain of the delete.
+			if entry.Bucket != nil {
+				err = s.runHooks(ctx, bucketLifecycleDelete, PostCommit,
+					func(ctx context.Context, h BucketLifecycleHook) error {
+						return h.OnDelete(ctx, PostCommit, entry.Bucket, DeleteBucketOptions{Force: true})
+					},
+					func(ctx context.Context, h BucketLifecycleHook) error { return nil },
+				)
+			}
+		case journalOpCreate:
+			// The metadata entry already committed by the time this was
+			// journaled; roll the create forward through the full
+			// PostCommit hook chain, exactly as CreateBucket itself does,
+			// so every registered subsystem observes the create rather
+			// than just the built-in engine hook.
+			if entry.Bucket == nil {
+				s.log.Error("Bucket lifecycle journal entry missing bucket data; leaving for next replay",
+					zap.Stringer("bucket_id", entry.BucketID))
+				return nil
+			}
+			err = s.runHooks(ctx, bucketLifecycleCreate, PostCommit,
+				func(ctx context.Context, h BucketLifecycleHook) error { return h.OnCreate(ctx, PostCommit, entry.Bucket) },
+				func(ctx context.Context, h BucketLifecycleHook) error {
+					return h.OnDelete(ctx, PreCommit, entry.Bucket, DeleteBucketOptions{Force: true})
+				},
+			)
+		case journalOpRetention:
+			b, ferr := s.FindBucketByID(ctx, entry.BucketID)
+			if ferr != nil {
+				err = ferr
+				break
+			}
+
+			if b.RetentionPeriod != entry.TargetRetention {
+				// The metadata commit never landed before the crash; the
+				// bucket is still on PrevRetention, so there is nothing to
+				// resume.
+				break
+			}
+
+			if st, serr := s.retentionQueue.status(ctx, entry.BucketID); serr != nil || st.TargetPeriod != entry.TargetRetention {
+				// The metadata commit landed, but the crash happened before
+				// retentionQueue persisted its own record of the pending
+				// apply (there is no record, or only one left by an earlier
+				// change to a different target); write one now so the
+				// engine-side change isn't lost forever.
+				err = s.retentionQueue.enqueue(ctx, entry.BucketID, entry.TargetRetention, entry.PrevRetention)
+			}
+		}
+
+		if err != nil {
+			s.log.Error("Unable to replay bucket lifecycle journal entry",
+				zap.String("op", string(entry.Op)),
+				zap.Stringer("bucket_id", entry.BucketID),
+				zap.Error(err))
+			return nil
+		}
+
+		return s.journal.clear(ctx, opID)
+	})
+}
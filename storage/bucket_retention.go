@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/v2"
+	"github.com/influxdata/influxdb/v2/kv"
+	"go.uber.org/zap"
+)
+
+// retentionApplyQueueBucket is the bolt bucket that backs the asynchronous
+// retention-period apply queue.
+var retentionApplyQueueBucket = []byte("bucketretentionqueue")
+
+// retentionWorkerCount bounds how many retention period changes the engine
+// applies concurrently.
+const retentionWorkerCount = 4
+
+// retentionQueueDepth bounds how many retention period changes can be
+// buffered waiting for a free worker before enqueue/resume falls back to a
+// background sender. Changes are always persisted as Pending first, so none
+// are lost regardless of depth; this only bounds how many wait in memory
+// versus on a dedicated goroutine.
+const retentionQueueDepth = 256
+
+// RetentionApplyState is the lifecycle state of an asynchronous retention
+// period change.
+type RetentionApplyState string
+
+const (
+	RetentionPending    RetentionApplyState = "pending"
+	RetentionInProgress RetentionApplyState = "in_progress"
+	RetentionApplied    RetentionApplyState = "applied"
+	RetentionFailed     RetentionApplyState = "failed"
+)
+
+// RetentionApplyStatus reports the progress of an asynchronous retention
+// period change enqueued by BucketService.UpdateBucket.
+type RetentionApplyStatus struct {
+	State RetentionApplyState `json:"state"`
+
+	// TargetPeriod is the retention period the change is moving the bucket
+	// to; PrevPeriod is the period that was in effect when it was enqueued.
+	TargetPeriod time.Duration `json:"targetPeriod"`
+	PrevPeriod   time.Duration `json:"prevPeriod"`
+
+	// LastErr holds the most recent error, if State is RetentionFailed.
+	LastErr string `json:"lastErr,omitempty"`
+}
+
+// ErrRetentionChangePending is returned by UpdateBucket when a bucket's
+// previous retention period change has not finished applying yet, unless
+// the caller passes UpdateBucketOptions{Force: true}.
+var ErrRetentionChangePending = &influxdb.Error{
+	Code: influxdb.EConflict,
+	Msg:  "a retention period change is already pending for this bucket, retry with Force to override",
+}
+
+// ErrNoRetentionChange is returned by GetBucketRetentionApplyStatus when no
+// retention period change has ever been recorded for the bucket.
+var ErrNoRetentionChange = &influxdb.Error{
+	Code: influxdb.ENotFound,
+	Msg:  "no retention period change on record for this bucket",
+}
+
+type retentionJob struct {
+	bucketID influxdb.ID
+	target   time.Duration
+}
+
+// retentionQueue applies retention period changes to the engine on a
+// bounded pool of background workers, persisting progress so a restart
+// resumes rather than loses in-flight changes.
+type retentionQueue struct {
+	store  kv.Store
+	log    *zap.Logger
+	engine EngineSchema
+
+	jobs chan retentionJob
+	wg   sync.WaitGroup
+}
+
+func newRetentionQueue(store kv.Store, log *zap.Logger, engine EngineSchema) *retentionQueue {
+	q := &retentionQueue{
+		store:  store,
+		log:    log,
+		engine: engine,
+		jobs:   make(chan retentionJob, retentionQueueDepth),
+	}
+
+	for i := 0; i < retentionWorkerCount; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+
+	return q
+}
+
+func (q *retentionQueue) work() {
+	defer q.wg.Done()
+	for job := range q.jobs {
+		q.apply(job)
+	}
+}
+
+func (q *retentionQueue) apply(job retentionJob) {
+	ctx := context.Background()
+
+	q.update(ctx, job.bucketID, func(st *RetentionApplyStatus) {
+		st.State = RetentionInProgress
+	})
+
+	if err := q.engine.UpdateBucketRetentionPeriod(ctx, job.bucketID, job.target); err != nil {
+		q.log.Error("Unable to apply retention period change",
+			zap.Stringer("bucket_id", job.bucketID), zap.Error(err))
+		q.update(ctx, job.bucketID, func(st *RetentionApplyStatus) {
+			st.State = RetentionFailed
+			st.LastErr = err.Error()
+		})
+		return
+	}
+
+	q.update(ctx, job.bucketID, func(st *RetentionApplyStatus) {
+		st.State = RetentionApplied
+		st.LastErr = ""
+	})
+}
+
+// enqueue records a pending retention period change for bucketID and hands
+// it to a worker.
+func (q *retentionQueue) enqueue(ctx context.Context, bucketID influxdb.ID, target, prev time.Duration) error {
+	if err := q.put(ctx, bucketID, RetentionApplyStatus{
+		State:        RetentionPending,
+		TargetPeriod: target,
+		PrevPeriod:   prev,
+	}); err != nil {
+		return err
+	}
+
+	q.send(retentionJob{bucketID: bucketID, target: target})
+	return nil
+}
+
+// send hands job to a worker without blocking the caller. If the queue is
+// momentarily full, the job is handed off to a background sender that
+// blocks until a worker frees up, rather than being dropped: a change must
+// still be picked up without waiting on the next process restart.
+func (q *retentionQueue) send(job retentionJob) {
+	select {
+	case q.jobs <- job:
+		return
+	default:
+	}
+
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		q.jobs <- job
+	}()
+}
+
+// resume re-enqueues every retention period change left Pending or
+// InProgress by a previous process, so a restart can't strand one.
+func (q *retentionQueue) resume(ctx context.Context) error {
+	return q.store.View(ctx, func(tx kv.Tx) error {
+		bkt, err := tx.Bucket(retentionApplyQueueBucket)
+		if err != nil {
+			return err
+		}
+
+		cur, err := bkt.ForwardCursor(nil)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+
+		for k, v := cur.Next(); k != nil; k, v = cur.Next() {
+			var id influxdb.ID
+			if err := id.Decode(k); err != nil {
+				return err
+			}
+
+			var st RetentionApplyStatus
+			if err := json.Unmarshal(v, &st); err != nil {
+				return err
+			}
+
+			if st.State != RetentionPending && st.State != RetentionInProgress {
+				continue
+			}
+
+			q.send(retentionJob{bucketID: id, target: st.TargetPeriod})
+		}
+		return cur.Err()
+	})
+}
+
+func (q *retentionQueue) status(ctx context.Context, id influxdb.ID) (RetentionApplyStatus, error) {
+	var (
+		st    RetentionApplyStatus
+		found bool
+	)
+
+	err := q.store.View(ctx, func(tx kv.Tx) error {
+		bkt, err := tx.Bucket(retentionApplyQueueBucket)
+		if err != nil {
+			return err
+		}
+
+		key, err := id.Encode()
+		if err != nil {
+			return err
+		}
+
+		v, err := bkt.Get(key)
+		if err == kv.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		found = true
+		return json.Unmarshal(v, &st)
+	})
+	if err != nil {
+		return RetentionApplyStatus{}, err
+	}
+	if !found {
+		return RetentionApplyStatus{}, ErrNoRetentionChange
+	}
+
+	return st, nil
+}
+
+func (q *retentionQueue) put(ctx context.Context, id influxdb.ID, st RetentionApplyStatus) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	return q.store.Update(ctx, func(tx kv.Tx) error {
+		bkt, err := tx.Bucket(retentionApplyQueueBucket)
+		if err != nil {
+			return err
+		}
+		key, err := id.Encode()
+		if err != nil {
+			return err
+		}
+		return bkt.Put(key, data)
+	})
+}
+
+func (q *retentionQueue) update(ctx context.Context, id influxdb.ID, mutate func(*RetentionApplyStatus)) {
+	err := q.store.Update(ctx, func(tx kv.Tx) error {
+		bkt, err := tx.Bucket(retentionApplyQueueBucket)
+		if err != nil {
+			return err
+		}
+
+		key, err := id.Encode()
+		if err != nil {
+			return err
+		}
+
+		var st RetentionApplyStatus
+		if v, err := bkt.Get(key); err == nil {
+			if err := json.Unmarshal(v, &st); err != nil {
+				return err
+			}
+		} else if err != kv.ErrKeyNotFound {
+			return err
+		}
+
+		mutate(&st)
+
+		data, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+		return bkt.Put(key, data)
+	})
+	if err != nil {
+		q.log.Error("Unable to persist retention apply status", zap.Stringer("bucket_id", id), zap.Error(err))
+	}
+}
@@ -6,47 +6,143 @@ import (
 
 	"github.com/influxdata/influxdb/v2"
 	"github.com/influxdata/influxdb/v2/kit/tracing"
+	"github.com/influxdata/influxdb/v2/kv"
+	"github.com/influxdata/influxdb/v2/snowflake"
 	"go.uber.org/zap"
 )
 
 type EngineSchema interface {
 	CreateBucket(context.Context, *influxdb.Bucket) error
 	UpdateBucketRetentionPeriod(context.Context, influxdb.ID, time.Duration) error
-	DeleteBucket(context.Context, influxdb.ID, influxdb.ID) error
+	DeleteBucket(context.Context, influxdb.ID, influxdb.ID, DeleteBucketOptions) error
+}
+
+// DeleteBucketOptions controls how the engine drops a bucket's data.
+type DeleteBucketOptions struct {
+	// Force drops the bucket even if it still contains series or
+	// measurements. When false, the engine refuses to delete a non-empty
+	// bucket and returns ErrBucketNotEmpty.
+	Force bool
+
+	// NoRecreate, when true, tells BucketService not to recreate the bucket
+	// in the engine (by re-running every hook's OnCreate) if the metadata
+	// delete fails after the engine has already dropped the data. This
+	// mirrors, with an opt-out, the rollback CreateBucket performs when the
+	// engine create fails. An engine-side delete failure never needs this:
+	// the metadata entry is not touched until the engine delete succeeds.
+	NoRecreate bool
+}
+
+// ErrBucketAlreadyExists is returned by BucketService.CreateBucket when a
+// bucket with the same name already exists within the target organization.
+var ErrBucketAlreadyExists = &influxdb.Error{
+	Code: influxdb.EConflict,
+	Msg:  "bucket already exists",
+}
+
+// ErrBucketNotEmpty is returned when DeleteBucket is called without Force on
+// a bucket that still contains series or measurements.
+var ErrBucketNotEmpty = &influxdb.Error{
+	Code: influxdb.EConflict,
+	Msg:  "bucket still contains data, retry with Force to delete anyway",
 }
 
 // BucketService wraps an existing influxdb.BucketService implementation.
 //
 // BucketService ensures that when a bucket is deleted, all stored data
 // associated with the bucket is either removed, or marked to be removed via a
-// future compaction.
+// future compaction. It journals each create, delete and retention period
+// change so a crash between the metadata store write and the engine write
+// can be rolled forward or back on the next startup; the engine-side apply of
+// a retention period change is tracked by retentionQueue, since it runs
+// asynchronously.
 type BucketService struct {
 	influxdb.BucketService
-	log    *zap.Logger
-	engine EngineSchema
+	log            *zap.Logger
+	engine         EngineSchema
+	journal        *bucketJournal
+	idGen          influxdb.IDGenerator
+	hooks          []registeredHook
+	retentionQueue *retentionQueue
+}
+
+// UpdateBucketOptions controls how BucketService.UpdateBucket handles a
+// retention period change.
+type UpdateBucketOptions struct {
+	// Force allows a new retention period change to be queued even though a
+	// previous one for the same bucket has not finished applying yet.
+	Force bool
 }
 
 // NewBucketService returns a new BucketService for the provided EngineSchema,
-// which typically will be an Engine.
-func NewBucketService(logger *zap.Logger, s influxdb.BucketService, engine EngineSchema) *BucketService {
-	return &BucketService{
-		BucketService: s,
-		engine:        engine,
-		log:           logger,
+// which typically will be an Engine. The engine is registered as the first
+// BucketLifecycleHook, named "engine"; call RegisterHook to add further
+// subsystems to the create/update/delete chain. store backs the bucket
+// lifecycle journal and the retention-apply queue; any entries left behind
+// by a previous process that crashed or restarted mid-mutation are replayed
+// or resumed before NewBucketService returns.
+func NewBucketService(logger *zap.Logger, s influxdb.BucketService, engine EngineSchema, store kv.Store) (*BucketService, error) {
+	bs := &BucketService{
+		BucketService:  s,
+		engine:         engine,
+		log:            logger,
+		journal:        newBucketJournal(store),
+		idGen:          snowflake.NewIDGenerator(),
+		retentionQueue: newRetentionQueue(store, logger, engine),
 	}
+	bs.RegisterHook("engine", &engineHook{engine: engine})
+
+	if err := bs.replay(context.Background()); err != nil {
+		return nil, err
+	}
+
+	if err := bs.retentionQueue.resume(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return bs, nil
+}
+
+// GetBucketRetentionApplyStatus reports the progress of an asynchronous
+// retention period change enqueued by UpdateBucket. It returns
+// ErrNoRetentionChange if no change has ever been recorded for id.
+func (s *BucketService) GetBucketRetentionApplyStatus(ctx context.Context, id influxdb.ID) (RetentionApplyStatus, error) {
+	return s.retentionQueue.status(ctx, id)
 }
 
 func (s *BucketService) CreateBucket(ctx context.Context, b *influxdb.Bucket) (err error) {
 	span, ctx := tracing.StartSpanFromContext(ctx)
 	defer span.Finish()
 
+	if _, findErr := s.FindBucket(ctx, influxdb.BucketFilter{
+		OrgID: &b.OrgID,
+		Name:  &b.Name,
+	}); findErr == nil {
+		return ErrBucketAlreadyExists
+	} else if influxdb.ErrorCode(findErr) != influxdb.ENotFound {
+		return findErr
+	}
+
+	if err = s.runHooks(ctx, bucketLifecycleCreate, PreCommit,
+		func(ctx context.Context, h BucketLifecycleHook) error { return h.OnCreate(ctx, PreCommit, b) },
+		func(ctx context.Context, h BucketLifecycleHook) error { return nil },
+	); err != nil {
+		return err
+	}
+
+	// Detach from the caller's context: a client that cancels its request
+	// right as the engine create fails must not be able to skip this
+	// rollback and leave a metadata entry for a bucket the engine never
+	// has data for.
+	engineCtx := context.Background()
+
 	defer func() {
 		if err == nil {
 			return
 		}
 
 		if b.ID.Valid() {
-			if err := s.BucketService.DeleteBucket(ctx, b.ID); err != nil {
+			if err := s.BucketService.DeleteBucket(engineCtx, b.ID); err != nil {
 				s.log.Error("Unable to cleanup bucket after create failed", zap.Error(err))
 			}
 		}
@@ -56,41 +152,215 @@ func (s *BucketService) CreateBucket(ctx context.Context, b *influxdb.Bucket) (e
 		return err
 	}
 
-	if err = s.engine.CreateBucket(ctx, b); err != nil {
+	opID := s.idGen.ID()
+	if err = s.journal.write(ctx, opID, journalEntry{
+		Op:       journalOpCreate,
+		BucketID: b.ID,
+		OrgID:    b.OrgID,
+		Bucket:   b,
+	}); err != nil {
 		return err
 	}
 
+	if err = s.runHooks(ctx, bucketLifecycleCreate, PostCommit,
+		func(ctx context.Context, h BucketLifecycleHook) error { return h.OnCreate(ctx, PostCommit, b) },
+		func(ctx context.Context, h BucketLifecycleHook) error {
+			return h.OnDelete(ctx, PreCommit, b, DeleteBucketOptions{Force: true})
+		},
+	); err != nil {
+		// The metadata entry is about to be rolled back by the deferred
+		// cleanup above; clear the journal entry too, or replay will
+		// recreate an orphaned engine bucket with no metadata behind it on
+		// the next ordinary restart.
+		if cerr := s.journal.clear(ctx, opID); cerr != nil {
+			s.log.Error("Unable to clear bucket lifecycle journal entry", zap.Error(cerr))
+		}
+		return err
+	}
+
+	if err = s.journal.clear(ctx, opID); err != nil {
+		s.log.Error("Unable to clear bucket lifecycle journal entry", zap.Error(err))
+	}
+
 	return nil
 }
 
-func (s *BucketService) UpdateBucket(ctx context.Context, id influxdb.ID, upd influxdb.BucketUpdate) (b *influxdb.Bucket, err error) {
+// UpdateBucket applies upd to the bucket identified by id. A retention
+// period change is persisted to the metadata store immediately, but is
+// applied to the engine asynchronously; use GetBucketRetentionApplyStatus to
+// track it. A second retention period change is refused with
+// ErrRetentionChangePending while one is still applying, unless
+// UpdateBucketOptions{Force: true} is passed.
+func (s *BucketService) UpdateBucket(ctx context.Context, id influxdb.ID, upd influxdb.BucketUpdate, opts ...UpdateBucketOptions) (*influxdb.Bucket, error) {
 	span, ctx := tracing.StartSpanFromContext(ctx)
 	defer span.Finish()
 
+	var opt UpdateBucketOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	existing, err := s.FindBucketByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if upd.RetentionPeriod != nil && !opt.Force {
+		if status, err := s.retentionQueue.status(ctx, id); err == nil &&
+			(status.State == RetentionPending || status.State == RetentionInProgress) {
+			return nil, ErrRetentionChangePending
+		}
+	}
+
+	prevRetention := existing.RetentionPeriod
+	revert := influxdb.BucketUpdate{RetentionPeriod: &prevRetention}
+
+	if err := s.runHooks(ctx, bucketLifecycleUpdate, PreCommit,
+		func(ctx context.Context, h BucketLifecycleHook) error { return h.OnUpdate(ctx, PreCommit, existing, upd) },
+		func(ctx context.Context, h BucketLifecycleHook) error { return nil },
+	); err != nil {
+		return nil, err
+	}
+
+	// A retention period change is journaled before the metadata commit, not
+	// after: unlike a create's bucket ID, everything the journal needs here
+	// (id, prevRetention, the target) is already known, so there is no
+	// reason to leave a gap between the metadata write and the durable
+	// record the way CreateBucket has to. This covers the crash window
+	// between the metadata commit below and retentionQueue persisting its
+	// own record, which would otherwise leave the metadata store pointing
+	// at a retention period the engine was never told to apply.
+	var retentionOpID influxdb.ID
 	if upd.RetentionPeriod != nil {
-		if err = s.engine.UpdateBucketRetentionPeriod(ctx, id, *upd.RetentionPeriod); err != nil {
+		retentionOpID = s.idGen.ID()
+		if err := s.journal.write(ctx, retentionOpID, journalEntry{
+			Op:              journalOpRetention,
+			BucketID:        id,
+			OrgID:           existing.OrgID,
+			PrevRetention:   prevRetention,
+			TargetRetention: *upd.RetentionPeriod,
+		}); err != nil {
 			return nil, err
 		}
 	}
 
-	return s.BucketService.UpdateBucket(ctx, id, upd)
+	b, err := s.BucketService.UpdateBucket(ctx, id, upd)
+	if err != nil {
+		if upd.RetentionPeriod != nil {
+			if cerr := s.journal.clear(ctx, retentionOpID); cerr != nil {
+				s.log.Error("Unable to clear bucket lifecycle journal entry", zap.Error(cerr))
+			}
+		}
+		return nil, err
+	}
+
+	if upd.RetentionPeriod != nil {
+		if err := s.retentionQueue.enqueue(ctx, id, *upd.RetentionPeriod, prevRetention); err != nil {
+			// The metadata store now reflects the new retention period, but
+			// nothing was queued to ever apply it to the engine; revert the
+			// metadata so the two stores don't silently diverge.
+			if _, rerr := s.BucketService.UpdateBucket(ctx, id, revert); rerr != nil {
+				s.log.Error("Unable to revert bucket retention period after enqueue failed",
+					zap.Stringer("bucket_id", id), zap.Error(rerr))
+			}
+			if cerr := s.journal.clear(ctx, retentionOpID); cerr != nil {
+				s.log.Error("Unable to clear bucket lifecycle journal entry", zap.Error(cerr))
+			}
+			return nil, err
+		}
+
+		if err := s.journal.clear(ctx, retentionOpID); err != nil {
+			s.log.Error("Unable to clear bucket lifecycle journal entry", zap.Error(err))
+		}
+	}
+
+	if err := s.runHooks(ctx, bucketLifecycleUpdate, PostCommit,
+		func(ctx context.Context, h BucketLifecycleHook) error { return h.OnUpdate(ctx, PostCommit, b, upd) },
+		func(ctx context.Context, h BucketLifecycleHook) error { return h.OnUpdate(ctx, PostCommit, b, revert) },
+	); err != nil {
+		return nil, err
+	}
+
+	return b, nil
 }
 
-// DeleteBucket removes a bucket by ID.
-func (s *BucketService) DeleteBucket(ctx context.Context, bucketID influxdb.ID) error {
+// DeleteBucket removes a bucket by ID. By default the engine refuses to drop
+// a bucket that still contains data; pass DeleteBucketOptions{Force: true} to
+// wipe it regardless. The engine delete runs, and is enforced, before the
+// metadata entry is touched, so a refusal (or any other engine failure)
+// leaves the metadata entry in place for the data the engine kept, rather
+// than deleting the metadata of a bucket whose data still exists.
+func (s *BucketService) DeleteBucket(ctx context.Context, bucketID influxdb.ID, opts ...DeleteBucketOptions) error {
 	span, ctx := tracing.StartSpanFromContext(ctx)
 	defer span.Finish()
 
+	var opt DeleteBucketOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
 	bucket, err := s.FindBucketByID(ctx, bucketID)
 	if err != nil {
 		return err
 	}
 
-	// The data is dropped first from the storage engine. If this fails for any
-	// reason, then the bucket will still be available in the future to retrieve
-	// the orgID, which is needed for the engine.
-	if err := s.engine.DeleteBucket(ctx, bucket.OrgID, bucketID); err != nil {
+	opID := s.idGen.ID()
+	if err := s.journal.write(ctx, opID, journalEntry{
+		Op:       journalOpDelete,
+		BucketID: bucketID,
+		OrgID:    bucket.OrgID,
+		Bucket:   bucket,
+	}); err != nil {
+		return err
+	}
+
+	if err := s.runHooks(ctx, bucketLifecycleDelete, PreCommit,
+		func(ctx context.Context, h BucketLifecycleHook) error { return h.OnDelete(ctx, PreCommit, bucket, opt) },
+		func(ctx context.Context, h BucketLifecycleHook) error { return nil },
+	); err != nil {
+		if cerr := s.journal.clear(ctx, opID); cerr != nil {
+			s.log.Error("Unable to clear bucket lifecycle journal entry", zap.Error(cerr))
+		}
+		return err
+	}
+
+	// Detach from the caller's context before handing off to the remaining
+	// hooks: a client that cancels its request mid-delete must not be able
+	// to leave other subsystems out of sync with a metadata delete that has
+	// already committed.
+	engineCtx := context.Background()
+
+	if err := s.BucketService.DeleteBucket(ctx, bucketID); err != nil {
+		// The engine has already dropped the bucket's data; leaving the
+		// metadata entry gone as well is what the caller asked for, but
+		// the metadata store rejected the delete, so the two stores are
+		// now inconsistent. Recreate the engine bucket so the metadata
+		// entry still has data behind it, unless the caller opted out
+		// with NoRecreate. Use engineCtx, not the caller's ctx: a client
+		// that cancels right as the metadata delete fails must not be
+		// able to skip this compensation.
+		if !opt.NoRecreate {
+			for i := len(s.hooks) - 1; i >= 0; i-- {
+				rh := s.hooks[i]
+				if rerr := rh.hook.OnCreate(engineCtx, PostCommit, bucket); rerr != nil {
+					s.log.Error("Unable to recreate bucket after metadata delete failed",
+						zap.String("hook", rh.name), zap.Error(rerr))
+				}
+			}
+		}
+		return err
+	}
+
+	if err := s.runHooks(engineCtx, bucketLifecycleDelete, PostCommit,
+		func(ctx context.Context, h BucketLifecycleHook) error { return h.OnDelete(ctx, PostCommit, bucket, opt) },
+		func(ctx context.Context, h BucketLifecycleHook) error { return nil },
+	); err != nil {
 		return err
 	}
-	return s.BucketService.DeleteBucket(ctx, bucketID)
+
+	if err := s.journal.clear(engineCtx, opID); err != nil {
+		s.log.Error("Unable to clear bucket lifecycle journal entry", zap.Error(err))
+	}
+
+	return nil
 }